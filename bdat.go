@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrBdatAbandoned is the error a backend's blocked Data/LMTPData read sees
+// when a BDAT transaction is abandoned before a LAST chunk completes it -
+// RSET, QUIT, or a fresh MAIL FROM mid-transaction. It never reaches the
+// wire: by the time Conn closes the pipe with it, the client has already
+// moved on to whatever ended the transaction.
+var ErrBdatAbandoned = errors.New("smtp: BDAT transaction abandoned before LAST")
+
+// bdatReader consumes RFC 3030 BDAT chunks from the wire and streams their
+// concatenated payload to a backend through an io.Pipe. Unlike dataReader it
+// performs no dot-unstuffing and does not interpret CR/LF at all: each
+// chunk is exactly the number of octets the client declared, which is what
+// makes BDAT safe to use for BODY=BINARYMIME content that dataReader's
+// line-oriented state machine would otherwise mangle.
+//
+// Conn is responsible for rejecting BDAT while a dataReader is already in
+// progress (and vice versa) before constructing a bdatReader, since only it
+// tracks which transfer mode the current transaction is in.
+type bdatReader struct {
+	r  *bufio.Reader
+	pw *io.PipeWriter
+
+	limited       bool
+	max           int64
+	bytesReceived int64
+}
+
+func newBdatReader(c *Conn, pw *io.PipeWriter) *bdatReader {
+	br := &bdatReader{
+		r:  c.text.R,
+		pw: pw,
+	}
+
+	if c.server.MaxMessageBytes > 0 {
+		br.limited = true
+		br.max = int64(c.server.MaxMessageBytes)
+	}
+
+	return br
+}
+
+// Chunk copies exactly size bytes from the wire into the pipe on behalf of
+// one BDAT command. If last is true the pipe is closed once the chunk has
+// been written so the backend's Data reader observes io.EOF; otherwise the
+// pipe is left open for the next BDAT chunk in the same transaction.
+//
+// On any error - the declared size pushing the transaction over
+// Server.MaxMessageBytes, or the client disconnecting before size bytes
+// arrive - the pipe is closed with that error so a backend blocked reading
+// from it is woken up rather than left hanging.
+func (br *bdatReader) Chunk(size int64, last bool) error {
+	if br.limited && br.bytesReceived+size > br.max {
+		br.pw.CloseWithError(ErrDataTooLarge)
+		return ErrDataTooLarge
+	}
+
+	n, err := io.CopyN(br.pw, br.r, size)
+	br.bytesReceived += n
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		br.pw.CloseWithError(err)
+		return err
+	}
+
+	if last {
+		return br.pw.Close()
+	}
+	return nil
+}
+
+// parseBdatArg parses the argument of a BDAT command, i.e. everything after
+// "BDAT ", returning the declared chunk size and whether it is marked LAST.
+func parseBdatArg(arg string) (size int64, last bool, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, &SMTPError{
+			Code:         CodeSyntaxErrArg.Basic,
+			EnhancedCode: CodeSyntaxErrArg.Enhanced,
+			Message:      "Malformed BDAT argument",
+		}
+	}
+
+	size, convErr := strconv.ParseInt(fields[0], 10, 64)
+	if convErr != nil || size < 0 {
+		return 0, false, &SMTPError{
+			Code:         CodeSyntaxErrArg.Basic,
+			EnhancedCode: CodeSyntaxErrArg.Enhanced,
+			Message:      "Malformed BDAT chunk size",
+		}
+	}
+
+	if len(fields) == 2 {
+		if !strings.EqualFold(fields[1], "LAST") {
+			return 0, false, &SMTPError{
+				Code:         CodeSyntaxErrArg.Basic,
+				EnhancedCode: CodeSyntaxErrArg.Enhanced,
+				Message:      "Malformed BDAT argument",
+			}
+		}
+		last = true
+	}
+
+	return size, last, nil
+}
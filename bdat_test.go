@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBdatReader_MultiChunk(t *testing.T) {
+	br := &bdatReader{r: bufio.NewReader(strings.NewReader("hello world"))}
+	pr, pw := io.Pipe()
+	br.pw = pw
+
+	done := make(chan error, 1)
+	go func() {
+		if err := br.Chunk(6, false); err != nil {
+			done <- err
+			return
+		}
+		done <- br.Chunk(5, true)
+	}()
+
+	got, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v, want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Chunk() error = %v, want nil", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("got %q, want %q", got, "hello world")
+	}
+}
+
+func TestBdatReader_RejectsOversizeAcrossChunks(t *testing.T) {
+	br := &bdatReader{
+		r:       bufio.NewReader(strings.NewReader("12345" + "67890")),
+		limited: true,
+		max:     8,
+	}
+	pr, pw := io.Pipe()
+	br.pw = pw
+
+	done := make(chan error, 1)
+	go func() {
+		if err := br.Chunk(5, false); err != nil {
+			done <- err
+			return
+		}
+		done <- br.Chunk(5, true)
+	}()
+
+	_, _ = io.ReadAll(pr)
+	err := <-done
+	if !errors.Is(err, ErrDataTooLarge) {
+		t.Fatalf("Chunk() error = %v, want ErrDataTooLarge", err)
+	}
+}
+
+func TestBdatReader_AbortsWhenClientDropsBeforeLast(t *testing.T) {
+	br := &bdatReader{r: bufio.NewReader(strings.NewReader("short"))}
+	pr, pw := io.Pipe()
+	br.pw = pw
+
+	done := make(chan error, 1)
+	go func() {
+		done <- br.Chunk(10, true)
+	}()
+
+	_, readErr := io.ReadAll(pr)
+	if !errors.Is(readErr, io.ErrUnexpectedEOF) {
+		t.Fatalf("backend read error = %v, want io.ErrUnexpectedEOF", readErr)
+	}
+	if err := <-done; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Chunk() error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestParseBdatArg(t *testing.T) {
+	tests := []struct {
+		arg      string
+		wantSize int64
+		wantLast bool
+		wantErr  bool
+	}{
+		{"1024", 1024, false, false},
+		{"1024 LAST", 1024, true, false},
+		{"1024 last", 1024, true, false},
+		{"0 LAST", 0, true, false},
+		{"", 0, false, true},
+		{"abc", 0, false, true},
+		{"-1", 0, false, true},
+		{"1024 NOTLAST", 0, false, true},
+		{"1024 LAST extra", 0, false, true},
+	}
+	for _, tc := range tests {
+		size, last, err := parseBdatArg(tc.arg)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseBdatArg(%q) error = nil, want error", tc.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBdatArg(%q) error = %v, want nil", tc.arg, err)
+			continue
+		}
+		if size != tc.wantSize || last != tc.wantLast {
+			t.Errorf("parseBdatArg(%q) = (%d, %v), want (%d, %v)", tc.arg, size, last, tc.wantSize, tc.wantLast)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package smtp
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// Conn represents a single client connection being served.
+type Conn struct {
+	conn   net.Conn
+	server *Server
+	text   *textproto.Conn
+
+	// lineLimiter is the limiter newConn installed below c.text, or nil if
+	// Server.MaxLineLength is zero. serve consults Violated() directly
+	// because bufio.Reader.ReadLine (which c.text.ReadLine wraps) hides the
+	// error on the call that first hits it - see the comment on
+	// lineLimitReader's violated field.
+	lineLimiter *lineLimitReader
+
+	session Session
+
+	// didHello is set once the peer has greeted with EHLO or LHLO; only
+	// then does WriteResponse include enhanced status codes. HELO leaves
+	// it unset.
+	didHello bool
+
+	fromReceived bool
+	recipients   []string
+
+	// lang is the client's language hint, picked up from a LANG= parameter
+	// on MAIL FROM; it's what Server.Localizer is keyed on. Empty means the
+	// client gave none.
+	lang string
+
+	// binarymime is set when the current transaction's MAIL FROM carried
+	// BODY=BINARYMIME, so BDAT chunks are known to be arbitrary octets
+	// rather than MIME text; bdatReader never scans for CR/LF either way.
+	binarymime bool
+
+	// bdat/bdatDone are non-nil for the duration of a BDAT transaction
+	// (from the first chunk up to and including LAST). Their presence is
+	// what lets handleData reject DATA while a BDAT transaction is in
+	// progress, per RFC 3030, and tells handleBdat whether a chunk starts
+	// a new transaction or continues the current one.
+	bdat     *bdatReader
+	bdatDone chan backendResult
+}
+
+func newConn(netConn net.Conn, s *Server) *Conn {
+	// Installing the limiter here, below textproto's own bufio.Reader,
+	// makes it cross-cutting: it bounds SMTP command lines read via
+	// c.text.ReadLine() and, since newDataReader reads from the very same
+	// c.text.R, DATA lines too - with a single instance of the enforcement
+	// rather than one per call site.
+	var r io.Reader = netConn
+	var lineLimiter *lineLimitReader
+	if s.MaxLineLength > 0 {
+		lineLimiter = newLineLimitReader(netConn, s.MaxLineLength)
+		r = lineLimiter
+	}
+
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{r, netConn, netConn}
+
+	return &Conn{
+		conn:        netConn,
+		server:      s,
+		text:        textproto.NewConn(rwc),
+		lineLimiter: lineLimiter,
+	}
+}
+
+func (c *Conn) serve() {
+	defer c.conn.Close()
+
+	session, err := c.server.Backend.NewSession(c)
+	if err != nil {
+		c.WriteResponse(CodeNotAvailable, "Service not available")
+		return
+	}
+	c.session = session
+	defer c.session.Logout()
+
+	greeting := "ESMTP Service Ready"
+	if c.server.LMTP {
+		greeting = "LMTP Service Ready"
+	}
+	c.WriteResponse(CodeReady, c.server.domain()+" "+greeting)
+
+	for {
+		line, err := c.text.ReadLine()
+		if err == nil && c.lineLimiter != nil && c.lineLimiter.Violated() {
+			// bufio.Reader.ReadLine (which c.text.ReadLine wraps) discards
+			// any error but ErrBufferFull on the call that first hits it,
+			// handing back the truncated line instead - and the bytes
+			// that came after the violation within that same underlying
+			// Read are queued in lineLimitReader.pending, so even the next
+			// Read call won't reproduce the error on its own. Treat the
+			// violation as the line's error directly rather than dispatch
+			// the truncated line as a command.
+			err = ErrLineTooLong
+		}
+		if err != nil {
+			// An oversize command line (Server.MaxLineLength) surfaces
+			// here as an *SMTPError from the lineLimitReader installed in
+			// newConn; report it before tearing down. Anything else (EOF,
+			// a reset connection, ...) isn't worth responding to.
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(CodePair{Basic: smtpErr.Code, Enhanced: smtpErr.EnhancedCode}, smtpErr.Message)
+			}
+			return
+		}
+
+		cmd, arg := parseCommand(line)
+		if c.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+// parseCommand splits an SMTP command line into its verb and argument.
+func parseCommand(line string) (cmd, arg string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return strings.ToUpper(line), ""
+	}
+	return strings.ToUpper(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// handle dispatches a single command. It returns true if the connection is
+// no longer usable and must be closed rather than continue serving further
+// commands.
+func (c *Conn) handle(cmd, arg string) bool {
+	switch cmd {
+	case "HELO":
+		if c.server.LMTP {
+			c.WriteResponse(CodeInvalidCmd, "This is an LMTP server, use LHLO")
+			return false
+		}
+		c.WriteResponse(CodeOk, "Hello")
+		return false
+	case "EHLO":
+		if c.server.LMTP {
+			c.WriteResponse(CodeInvalidCmd, "This is an LMTP server, use LHLO")
+			return false
+		}
+		c.didHello = true
+		// CHUNKING (RFC 3030) and BINARYMIME are unconditional: bdatReader
+		// and the BODY=BINARYMIME handling in handleMail are always
+		// available, there is no Server flag gating them.
+		c.WriteResponse(CodeOk, "Hello", "CHUNKING", "BINARYMIME")
+		return false
+	case "LHLO":
+		if !c.server.LMTP {
+			c.WriteResponse(CodeInvalidCmd, "This is an SMTP server, use HELO or EHLO")
+			return false
+		}
+		c.didHello = true
+		c.WriteResponse(CodeOk, "Hello", "CHUNKING", "BINARYMIME")
+		return false
+	case "MAIL":
+		return c.handleMail(arg)
+	case "RCPT":
+		return c.handleRcpt(arg)
+	case "DATA":
+		return c.handleData()
+	case "BDAT":
+		return c.handleBdat(arg)
+	case "RSET":
+		c.reset()
+		c.WriteResponse(CodeOk, "OK")
+		return false
+	case "NOOP":
+		c.WriteResponse(CodeOk, "OK")
+		return false
+	case "QUIT":
+		c.abortBdat()
+		c.WriteResponse(CodeBye, "Bye")
+		return true
+	default:
+		c.WriteResponse(CodeInvalidCmd, "Unsupported command")
+		return false
+	}
+}
+
+func (c *Conn) reset() {
+	c.abortBdat()
+	c.fromReceived = false
+	c.recipients = nil
+	c.lang = ""
+	c.binarymime = false
+	if c.session != nil {
+		c.session.Reset()
+	}
+}
+
+// abortBdat closes the pipe backing the BDAT transaction in progress, if
+// any, with ErrBdatAbandoned and drops it. When RSET, QUIT, or a fresh MAIL
+// FROM ends a BDAT transaction before its LAST chunk, the backend goroutine
+// is blocked on a pipe read that would otherwise never see EOF or an error.
+// When handleBdat calls reset after a LAST chunk or a failed chunk, the pipe
+// is already closed and CloseWithError leaves the backend's view unchanged.
+func (c *Conn) abortBdat() {
+	if c.bdat == nil {
+		return
+	}
+	c.bdat.pw.CloseWithError(ErrBdatAbandoned)
+	c.bdat = nil
+	c.bdatDone = nil
+}
+
+func (c *Conn) handleMail(arg string) bool {
+	if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+		c.WriteResponse(CodeSyntaxErrArg, "Malformed MAIL command")
+		return false
+	}
+
+	// A client is allowed to start a new transaction with MAIL FROM without
+	// sending RSET first; if the previous one left a BDAT transfer open,
+	// that would otherwise leak its pipe and backend goroutine exactly like
+	// an explicit RSET would.
+	c.abortBdat()
+
+	from := strings.TrimSpace(arg[len("FROM:"):])
+	if err := c.session.Mail(from); err != nil {
+		c.writeError(err)
+		return false
+	}
+
+	c.fromReceived = true
+	c.binarymime = strings.Contains(strings.ToUpper(arg), "BODY=BINARYMIME")
+	c.lang = mailFromParam(arg, "LANG")
+	c.WriteResponse(CodeOk, "OK")
+	return false
+}
+
+// mailFromParam returns the value of the "key=value" parameter in a MAIL
+// FROM argument, matched case-insensitively on key, or the empty string if
+// it isn't present.
+func mailFromParam(arg, key string) string {
+	prefix := strings.ToUpper(key) + "="
+	idx := strings.Index(strings.ToUpper(arg), prefix)
+	if idx < 0 {
+		return ""
+	}
+
+	rest := arg[idx+len(prefix):]
+	if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+		rest = rest[:sp]
+	}
+	return rest
+}
+
+func (c *Conn) handleRcpt(arg string) bool {
+	if !c.fromReceived {
+		c.WriteResponse(CodeInvalidSequence, "MAIL is required before RCPT")
+		return false
+	}
+	if !strings.HasPrefix(strings.ToUpper(arg), "TO:") {
+		c.WriteResponse(CodeSyntaxErrArg, "Malformed RCPT command")
+		return false
+	}
+
+	to := strings.TrimSpace(arg[len("TO:"):])
+	if err := c.session.Rcpt(to); err != nil {
+		c.writeError(err)
+		return false
+	}
+
+	c.recipients = append(c.recipients, to)
+	c.WriteResponse(CodeOk, "OK")
+	return false
+}
+
+func (c *Conn) handleData() bool {
+	if !c.fromReceived || len(c.recipients) == 0 {
+		c.WriteResponse(CodeInvalidSequence, "MAIL & RCPT are required before DATA")
+		return false
+	}
+	if c.bdat != nil {
+		c.WriteResponse(CodeInvalidSequence, "DATA not allowed during an unfinished BDAT transaction")
+		return false
+	}
+
+	c.WriteResponse(CodeStartMail, "Start mail input; end with <CRLF>.<CRLF>")
+
+	dr := newDataReader(c)
+	c.writeBackendResult(c.runBackendData(dr))
+
+	// A bare CR/LF (Server.Strict) or an oversize line desynchronizes the
+	// DATA framing; the connection can no longer be trusted and must be
+	// torn down rather than continue to the next command.
+	unrecoverable := dr.Unrecoverable()
+	c.reset()
+	return unrecoverable
+}
+
+// handleBdat implements one BDAT command. A transaction may span several
+// BDAT commands; c.bdat/c.bdatDone carry the in-progress state between
+// handle calls until a chunk marked LAST completes it.
+func (c *Conn) handleBdat(arg string) bool {
+	if !c.fromReceived || len(c.recipients) == 0 {
+		c.WriteResponse(CodeInvalidSequence, "MAIL & RCPT are required before BDAT")
+		return false
+	}
+
+	size, last, err := parseBdatArg(arg)
+	if err != nil {
+		c.writeError(err)
+		return false
+	}
+
+	if c.bdat == nil {
+		// First chunk of a new transaction: hand the backend the read end
+		// of the pipe up front, so it consumes the message concurrently
+		// with the chunks still arriving on the wire.
+		pr, pw := io.Pipe()
+		c.bdat = newBdatReader(c, pw)
+		c.bdatDone = make(chan backendResult, 1)
+		go func() {
+			c.bdatDone <- c.runBackendData(pr)
+		}()
+	}
+
+	if err := c.bdat.Chunk(size, last); err != nil {
+		// The declared size pushed the transaction over
+		// Server.MaxMessageBytes, or the client disconnected mid-chunk;
+		// either way the wire is no longer aligned with what we expect to
+		// read next, so the connection must be closed rather than
+		// continue to the next command - matching how dataReader's
+		// Unrecoverable is handled for plain DATA.
+		c.writeError(err)
+		c.reset()
+		return true
+	}
+
+	if !last {
+		c.WriteResponse(CodeOk, "OK")
+		return false
+	}
+
+	c.writeBackendResult(<-c.bdatDone)
+	c.reset()
+	return false
+}
+
+// backendResult carries the outcome of a completed DATA/BDAT transfer back
+// from runBackendData to whichever of handleData/handleBdat is waiting on
+// it, so the response(s) can be written once the stream has been fully
+// consumed.
+type backendResult struct {
+	// status is non-nil only in LMTP mode, for a session that implements
+	// LMTPSession; it holds one status per recipient, to be written out in
+	// RCPT order instead of a single aggregate response.
+	status *statusCollector
+	err    error
+}
+
+// runBackendData hands r to the current session's Data method, or - in LMTP
+// mode, when the session implements LMTPSession - to LMTPData along with a
+// statusCollector sized to the current recipient list. It does not write
+// any response itself; call writeBackendResult with its return value once
+// the stream has been fully read.
+func (c *Conn) runBackendData(r io.Reader) backendResult {
+	if c.server.LMTP {
+		if lmtpSession, ok := c.session.(LMTPSession); ok {
+			status := newStatusCollector(len(c.recipients))
+			err := lmtpSession.LMTPData(r, status)
+			return backendResult{status: status, err: err}
+		}
+	}
+	return backendResult{err: c.session.Data(r)}
+}
+
+// writeBackendResult writes the response(s) for a completed DATA/BDAT
+// transfer: one line per recipient, in RCPT order, when res came from an
+// LMTPSession, or a single aggregate response otherwise. A recipient with
+// no status of its own falls back to res.err, e.g. when LMTPData returns an
+// error before reporting any per-recipient outcome at all.
+func (c *Conn) writeBackendResult(res backendResult) {
+	if res.status != nil {
+		for i := range c.recipients {
+			if err := res.status.Status(i); err != nil {
+				c.writeError(err)
+			} else if res.err != nil {
+				c.writeError(res.err)
+			} else {
+				c.WriteResponse(CodeOk, "OK")
+			}
+		}
+		return
+	}
+
+	if res.err != nil {
+		c.writeError(res.err)
+	} else {
+		c.WriteResponse(CodeOk, "OK")
+	}
+}
+
+func (c *Conn) writeError(err error) {
+	if smtpErr, ok := err.(*SMTPError); ok {
+		c.WriteResponse(CodePair{Basic: smtpErr.Code, Enhanced: smtpErr.EnhancedCode}, smtpErr.Message)
+		return
+	}
+	c.WriteResponse(CodeActionAborted, err.Error())
+}
+
+// WriteResponse writes a formatted, possibly multi-line reply to the
+// client, including the enhanced code only once the peer has said
+// EHLO/LHLO. If Server.Localizer is set, it is given the chance to
+// replace msg with code's translated default message for c.lang before the
+// reply is framed; returning "" from it leaves msg untouched. Backends can
+// call this directly to send informational multi-line replies such as a
+// banner or HELP text.
+func (c *Conn) WriteResponse(code CodePair, msg ...string) error {
+	if c.server.Localizer != nil {
+		if translated := c.server.Localizer(code, c.lang); translated != "" {
+			msg = []string{translated}
+		}
+	}
+	if err := writeResponse(c.text.W, code, c.didHello, msg...); err != nil {
+		return err
+	}
+	return c.text.W.Flush()
+}
@@ -0,0 +1,599 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubSession struct {
+	backend *stubBackend
+}
+
+func (s *stubSession) Mail(from string) error { return nil }
+func (s *stubSession) Rcpt(to string) error   { return nil }
+
+func (s *stubSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	s.backend.gotData = b
+	return err
+}
+
+func (s *stubSession) Reset()        {}
+func (s *stubSession) Logout() error { return nil }
+
+type stubBackend struct {
+	gotData  []byte
+	lastConn *Conn
+}
+
+func (b *stubBackend) NewSession(c *Conn) (Session, error) {
+	b.lastConn = c
+	return &stubSession{backend: b}, nil
+}
+
+// stubLMTPSession implements LMTPSession to exercise Conn's per-recipient
+// status serialization. statuses[i] is reported for the i'th recipient;
+// a nil entry (or an index past the end of statuses) means success.
+type stubLMTPSession struct {
+	stubSession
+	statuses []error
+}
+
+func (s *stubLMTPSession) LMTPData(r io.Reader, status StatusCollector) error {
+	b, err := io.ReadAll(r)
+	s.backend.gotData = b
+	if err != nil {
+		return err
+	}
+	for i := range s.statuses {
+		status.SetStatus(i, s.statuses[i])
+	}
+	return nil
+}
+
+type stubLMTPBackend struct {
+	stubBackend
+	statuses []error
+}
+
+func (b *stubLMTPBackend) NewSession(c *Conn) (Session, error) {
+	b.lastConn = c
+	return &stubLMTPSession{stubSession: stubSession{backend: &b.stubBackend}, statuses: b.statuses}, nil
+}
+
+// signalingSession behaves like stubSession, but reports the error its Data
+// call returned on done - so a test can observe a backend call that was
+// blocked reading from a BDAT pipe actually unblock, rather than just
+// trusting it eventually would.
+type signalingSession struct {
+	stubSession
+	done chan error
+}
+
+func (s *signalingSession) Data(r io.Reader) error {
+	_, err := io.ReadAll(r)
+	s.done <- err
+	return err
+}
+
+type signalingBackend struct {
+	stubBackend
+	done chan error
+}
+
+func (b *signalingBackend) NewSession(c *Conn) (Session, error) {
+	b.lastConn = c
+	return &signalingSession{stubSession: stubSession{backend: &b.stubBackend}, done: b.done}, nil
+}
+
+// newTestConn starts serving s on one end of an in-memory pipe and returns
+// a buffered client reader/writer for the other end.
+func newTestConn(t *testing.T, s *Server) (*bufio.Reader, net.Conn) {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+	c := newConn(serverSide, s)
+	go c.serve()
+	return bufio.NewReader(clientSide), clientSide
+}
+
+func sendLine(t *testing.T, conn net.Conn, line string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+		t.Fatalf("write %q: %v", line, err)
+	}
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestConn_HappyPath(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	if got := readLine(t, r); !strings.HasPrefix(got, "220 ") {
+		t.Fatalf("greeting = %q, want 220 prefix", got)
+	}
+
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r) // 250-...Hello
+	readLine(t, r) // 250-...CHUNKING
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("EHLO response = %q", got)
+	}
+
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("MAIL response = %q", got)
+	}
+
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("RCPT response = %q", got)
+	}
+
+	sendLine(t, conn, "DATA")
+	if got := readLine(t, r); !strings.HasPrefix(got, "354 ") {
+		t.Fatalf("DATA response = %q", got)
+	}
+
+	sendLine(t, conn, "hello world")
+	sendLine(t, conn, ".")
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("end-of-DATA response = %q", got)
+	}
+	if string(backend.gotData) != "hello world\r\n" {
+		t.Fatalf("backend got %q", backend.gotData)
+	}
+
+	sendLine(t, conn, "QUIT")
+	if got := readLine(t, r); !strings.HasPrefix(got, "221 ") {
+		t.Fatalf("QUIT response = %q", got)
+	}
+}
+
+func TestConn_MaxLineLengthRejectsOversizeCommandLine(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend, MaxLineLength: 32}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+
+	sendLine(t, conn, "NOOP "+strings.Repeat("x", 64))
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 5.4.0") {
+		t.Fatalf("oversize command line response = %q, want 500 5.4.0 prefix", got)
+	}
+
+	_, _ = io.WriteString(conn, "NOOP\r\n")
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("expected connection to be closed after oversize command line")
+	}
+}
+
+func TestConn_MaxLineLengthRejectsOversizeDataLine(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend, MaxLineLength: 40}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "DATA")
+	readLine(t, r) // 354
+
+	sendLine(t, conn, strings.Repeat("y", 64))
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 5.4.0") {
+		t.Fatalf("oversize DATA line response = %q, want 500 5.4.0 prefix", got)
+	}
+}
+
+func TestConn_StrictTearsDownOnBareLineEnding(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend, Strict: true}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "DATA")
+	readLine(t, r) // 354
+
+	// A bare LF inside DATA is a smuggling attempt; the server must reject
+	// it and close the connection rather than accept further commands.
+	if _, err := io.WriteString(conn, "\n.\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 ") {
+		t.Fatalf("bare line ending response = %q, want 500 prefix", got)
+	}
+
+	// The server should have already closed its end; whether or not this
+	// write itself errors, the connection must not yield a further
+	// response.
+	_, _ = io.WriteString(conn, "NOOP\r\n")
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("expected connection to be closed after bare line ending, but NOOP got a response")
+	}
+}
+
+func TestConn_EHLOAdvertisesChunkingAndBinaryMime(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+
+	var lines []string
+	for i := 0; i < 3; i++ {
+		lines = append(lines, readLine(t, r))
+	}
+	joined := strings.Join(lines, "\n")
+	if !strings.Contains(joined, "CHUNKING") {
+		t.Fatalf("EHLO response = %v, want a CHUNKING line", lines)
+	}
+	if !strings.Contains(joined, "BINARYMIME") {
+		t.Fatalf("EHLO response = %v, want a BINARYMIME line", lines)
+	}
+}
+
+func TestConn_MailBodyBinaryMimeSetsFlag(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+
+	sendLine(t, conn, "MAIL FROM:<alice@example.org> BODY=BINARYMIME")
+	readLine(t, r)
+
+	if !backend.lastConn.binarymime {
+		t.Fatal("Conn.binarymime = false, want true after MAIL FROM BODY=BINARYMIME")
+	}
+}
+
+func TestConn_BdatMultiChunk(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "BDAT 6")
+	if _, err := io.WriteString(conn, "hello "); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("first BDAT response = %q", got)
+	}
+
+	sendLine(t, conn, "BDAT 5 LAST")
+	if _, err := io.WriteString(conn, "world"); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("last BDAT response = %q", got)
+	}
+
+	if string(backend.gotData) != "hello world" {
+		t.Fatalf("backend got %q, want %q", backend.gotData, "hello world")
+	}
+}
+
+func TestConn_RejectsDataDuringUnfinishedBdat(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "BDAT 6")
+	if _, err := io.WriteString(conn, "hello "); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	readLine(t, r) // 250 after first chunk
+
+	sendLine(t, conn, "DATA")
+	if got := readLine(t, r); !strings.HasPrefix(got, "503 ") {
+		t.Fatalf("DATA during unfinished BDAT response = %q, want 503 prefix", got)
+	}
+
+	// Finish the BDAT transaction so the backend goroutine it started
+	// doesn't leak past the end of the test.
+	sendLine(t, conn, "BDAT 0 LAST")
+	readLine(t, r)
+}
+
+func TestConn_RsetDuringUnfinishedBdatUnblocksBackend(t *testing.T) {
+	done := make(chan error, 1)
+	backend := &signalingBackend{done: done}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "BDAT 6")
+	if _, err := io.WriteString(conn, "hello "); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	readLine(t, r) // 250 after first chunk; transaction left open, no LAST
+
+	sendLine(t, conn, "RSET")
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("RSET response = %q", got)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBdatAbandoned) {
+			t.Fatalf("backend Data() error = %v, want ErrBdatAbandoned", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend Data() blocked on the BDAT pipe past RSET, want it unblocked")
+	}
+}
+
+func TestConn_QuitDuringUnfinishedBdatUnblocksBackend(t *testing.T) {
+	done := make(chan error, 1)
+	backend := &signalingBackend{done: done}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "BDAT 6")
+	if _, err := io.WriteString(conn, "hello "); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	readLine(t, r) // 250 after first chunk; transaction left open, no LAST
+
+	sendLine(t, conn, "QUIT")
+	if got := readLine(t, r); !strings.HasPrefix(got, "221 ") {
+		t.Fatalf("QUIT response = %q", got)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBdatAbandoned) {
+			t.Fatalf("backend Data() error = %v, want ErrBdatAbandoned", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend Data() blocked on the BDAT pipe past QUIT, want it unblocked")
+	}
+}
+
+func TestConn_FreshMailFromDuringUnfinishedBdatUnblocksBackend(t *testing.T) {
+	done := make(chan error, 1)
+	backend := &signalingBackend{done: done}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "BDAT 6")
+	if _, err := io.WriteString(conn, "hello "); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	readLine(t, r) // 250 after first chunk; transaction left open, no LAST
+
+	// No RSET: a new MAIL FROM without one must still close the stale pipe.
+	sendLine(t, conn, "MAIL FROM:<alice2@example.org>")
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("fresh MAIL FROM response = %q", got)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBdatAbandoned) {
+			t.Fatalf("backend Data() error = %v, want ErrBdatAbandoned", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend Data() blocked on the BDAT pipe past the fresh MAIL FROM, want it unblocked")
+	}
+}
+
+func TestConn_LMTPRejectsHeloAndEhlo(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend, LMTP: true}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+
+	sendLine(t, conn, "HELO client.example.org")
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 ") {
+		t.Fatalf("HELO in LMTP mode response = %q, want 500 prefix", got)
+	}
+
+	sendLine(t, conn, "EHLO client.example.org")
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 ") {
+		t.Fatalf("EHLO in LMTP mode response = %q, want 500 prefix", got)
+	}
+
+	sendLine(t, conn, "LHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("LHLO response = %q", got)
+	}
+}
+
+func TestConn_SMTPRejectsLhlo(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+
+	sendLine(t, conn, "LHLO client.example.org")
+	if got := readLine(t, r); !strings.HasPrefix(got, "500 ") {
+		t.Fatalf("LHLO in SMTP mode response = %q, want 500 prefix", got)
+	}
+}
+
+func TestConn_LMTPSerializesPerRecipientStatusAfterData(t *testing.T) {
+	rcpt1Err := &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "mailbox unavailable"}
+	backend := &stubLMTPBackend{statuses: []error{nil, rcpt1Err}}
+	s := &Server{Backend: backend, LMTP: true}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "LHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+
+	sendLine(t, conn, "MAIL FROM:<alice@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<bob@example.org>")
+	readLine(t, r)
+	sendLine(t, conn, "RCPT TO:<carol@example.org>")
+	readLine(t, r)
+
+	sendLine(t, conn, "DATA")
+	readLine(t, r) // 354
+
+	sendLine(t, conn, "hello world")
+	sendLine(t, conn, ".")
+
+	if got := readLine(t, r); !strings.HasPrefix(got, "250 ") {
+		t.Fatalf("status for bob = %q, want 250 prefix", got)
+	}
+	if got := readLine(t, r); !strings.HasPrefix(got, "550 ") {
+		t.Fatalf("status for carol = %q, want 550 prefix", got)
+	}
+}
+
+func TestConn_MailFromLangSetsLang(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{Backend: backend}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+
+	sendLine(t, conn, "MAIL FROM:<alice@example.org> LANG=fr")
+	readLine(t, r)
+
+	if backend.lastConn.lang != "fr" {
+		t.Fatalf("Conn.lang = %q, want %q", backend.lastConn.lang, "fr")
+	}
+}
+
+func TestConn_LocalizerTranslatesResponses(t *testing.T) {
+	backend := &stubBackend{}
+	s := &Server{
+		Backend: backend,
+		Localizer: func(code CodePair, lang string) string {
+			if code.Basic == 221 && lang == "fr" {
+				return "Au revoir"
+			}
+			return ""
+		},
+	}
+	r, conn := newTestConn(t, s)
+	defer conn.Close()
+
+	readLine(t, r) // greeting
+	sendLine(t, conn, "EHLO client.example.org")
+	readLine(t, r)
+	readLine(t, r)
+	readLine(t, r)
+
+	sendLine(t, conn, "MAIL FROM:<alice@example.org> LANG=fr")
+	readLine(t, r)
+
+	sendLine(t, conn, "QUIT")
+	if got := readLine(t, r); !strings.HasSuffix(got, "Au revoir") {
+		t.Fatalf("QUIT response = %q, want it to end with the localized message", got)
+	}
+}
@@ -102,17 +102,39 @@ var ErrDataTooLarge = &SMTPError{
 	Message:      "Maximum message size exceeded",
 }
 
+// ErrBareLineEnding is returned by dataReader.Read when Server.Strict is
+// enabled and a CR or LF is encountered inside DATA without its matching
+// partner. Accepting such bare line endings is what lets an SMTP smuggling
+// attack slip a fake end-of-data sequence past this server so a downstream
+// MTA re-frames the message differently. Once this error is returned the
+// DATA stream is desynchronized and cannot be safely resumed; callers must
+// treat the connection as unrecoverable.
+var ErrBareLineEnding = &SMTPError{
+	Code:         CodeSyntaxErrCmd.Basic,
+	EnhancedCode: CodeSyntaxErrCmd.Enhanced,
+	Message:      "bare CR/LF not allowed in DATA",
+}
+
 type dataReader struct {
 	r     *bufio.Reader
 	state int
 
 	limited bool
 	n       int64 // Maximum bytes remaining
+
+	strict        bool
+	unrecoverable bool
 }
 
 func newDataReader(c *Conn) *dataReader {
+	// Server.MaxLineLength is enforced once, below c.text's own
+	// bufio.Reader, by the lineLimitReader Conn installs at connection
+	// setup (see newConn) - it already covers DATA lines since r reads
+	// from that same underlying stream, so no separate wrapping is needed
+	// here.
 	dr := &dataReader{
-		r: c.text.R,
+		r:      c.text.R,
+		strict: c.server.Strict,
 	}
 
 	if c.server.MaxMessageBytes > 0 {
@@ -123,6 +145,13 @@ func newDataReader(c *Conn) *dataReader {
 	return dr
 }
 
+// Unrecoverable reports whether a protocol violation has left the
+// underlying connection desynchronized, meaning the caller must close it
+// instead of continuing to read further commands.
+func (r *dataReader) Unrecoverable() bool {
+	return r.unrecoverable
+}
+
 func (r *dataReader) Read(b []byte) (n int, err error) {
 	if r.limited {
 		if r.n <= 0 {
@@ -152,9 +181,23 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		if err != nil {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
+			} else if _, ok := err.(*SMTPError); ok {
+				// The underlying reader (e.g. a lineLimitReader) detected a
+				// protocol violation mid-stream; the framing can no longer
+				// be trusted.
+				r.unrecoverable = true
 			}
 			break
 		}
+		if r.strict {
+			bareCR := (r.state == stateCR || r.state == stateDotCR) && c != '\n'
+			bareLF := c == '\n' && r.state != stateCR && r.state != stateDotCR
+			if bareCR || bareLF {
+				r.unrecoverable = true
+				err = ErrBareLineEnding
+				break
+			}
+		}
 		switch r.state {
 		case stateBeginLine:
 			if c == '.' {
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestDataReader(strict bool, input string) *dataReader {
+	return &dataReader{
+		r:      bufio.NewReader(strings.NewReader(input)),
+		strict: strict,
+	}
+}
+
+func readAll(r *dataReader) ([]byte, error) {
+	return io.ReadAll(r)
+}
+
+func TestDataReader_StrictRejectsBareLineEndings(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"bare LF then dot then bare LF", "\n.\n"},
+		{"bare CR then dot then bare CR", "\r.\r"},
+		{"bare LF then dot then CRLF", "\n.\r\n"},
+		{"CRLF then dot then bare LF", "\r\n.\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dr := newTestDataReader(true, tc.input)
+			_, err := readAll(dr)
+			var smtpErr *SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr != ErrBareLineEnding {
+				t.Fatalf("Read() error = %v, want ErrBareLineEnding", err)
+			}
+			if !dr.Unrecoverable() {
+				t.Fatal("Unrecoverable() = false, want true after bare line ending")
+			}
+		})
+	}
+}
+
+func TestDataReader_StrictAcceptsProperCRLFTerminator(t *testing.T) {
+	dr := newTestDataReader(true, "hello world\r\n.\r\n")
+	b, err := readAll(dr)
+	if err != nil {
+		t.Fatalf("Read() error = %v, want nil", err)
+	}
+	if string(b) != "hello world\r\n" {
+		t.Fatalf("Read() = %q, want %q", b, "hello world\r\n")
+	}
+	if dr.Unrecoverable() {
+		t.Fatal("Unrecoverable() = true, want false for well-formed input")
+	}
+}
+
+func TestDataReader_NonStrictAllowsBareLineEndings(t *testing.T) {
+	dr := newTestDataReader(false, "\n.\n\r\n.\r\n")
+	b, err := readAll(dr)
+	if err != nil {
+		t.Fatalf("Read() error = %v, want nil", err)
+	}
+	if string(b) != "\n.\n\r\n" {
+		t.Fatalf("Read() = %q, want %q", b, "\n.\n\r\n")
+	}
+}
@@ -0,0 +1,74 @@
+package smtp
+
+import "io"
+
+// ErrLineTooLong is returned when a single line read from the client -
+// whether an SMTP command or a line inside DATA - exceeds Server.MaxLineLength
+// without being terminated. Accepting unbounded lines lets a client force
+// the server to buffer or scan indefinitely, so this is treated as a
+// permanent error.
+var ErrLineTooLong = &SMTPError{
+	Code:         CodeLineTooLong.Basic,
+	EnhancedCode: CodeLineTooLong.Enhanced,
+	Message:      "Line too long",
+}
+
+// lineLimitReader wraps an io.Reader and caps the number of bytes that may
+// be read between two '\n' bytes. Conn installs one beneath its
+// textproto.Conn at connection setup, so it bounds both SMTP command lines
+// and - since dataReader reads from that same underlying reader - lines
+// inside the DATA stream, without either needing its own copy.
+type lineLimitReader struct {
+	r       io.Reader
+	max     int
+	lineLen int
+	pending []byte // bytes already read from r but not yet returned to the caller
+
+	// violated sticks at true once a line has exceeded max, independent of
+	// the transient error Read returns for that one call. Conn needs this:
+	// bufio.Reader.ReadLine (which underlies textproto.Conn.ReadLine)
+	// discards any error other than ErrBufferFull on the call that first
+	// hits it, handing back the partial line instead; no later call
+	// surfaces that error either. violated lets Conn notice the
+	// violation immediately instead of dispatching that partial line as a
+	// command.
+	violated bool
+}
+
+func newLineLimitReader(r io.Reader, max int) *lineLimitReader {
+	return &lineLimitReader{r: r, max: max}
+}
+
+// Violated reports whether a line over max has been seen at any point.
+func (lr *lineLimitReader) Violated() bool {
+	return lr.violated
+}
+
+func (lr *lineLimitReader) Read(b []byte) (int, error) {
+	if len(lr.pending) > 0 {
+		n := copy(b, lr.pending)
+		lr.pending = lr.pending[n:]
+		return n, nil
+	}
+
+	n, err := lr.r.Read(b)
+	for i := 0; i < n; i++ {
+		if b[i] == '\n' {
+			lr.lineLen = 0
+			continue
+		}
+		lr.lineLen++
+		if lr.lineLen > lr.max {
+			lr.violated = true
+			// Bytes already pulled from the underlying reader past the
+			// violation belong to whatever comes next (the caller is free
+			// to keep reading after handling the error); stash them
+			// instead of discarding them.
+			if i+1 < n {
+				lr.pending = append(lr.pending, b[i+1:n]...)
+			}
+			return i + 1, ErrLineTooLong
+		}
+	}
+	return n, err
+}
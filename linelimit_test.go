@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineLimitReader_AllowsLinesUnderLimit(t *testing.T) {
+	lr := newLineLimitReader(strings.NewReader("short\nlines\n"), 16)
+	b, err := io.ReadAll(lr)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v, want nil", err)
+	}
+	if string(b) != "short\nlines\n" {
+		t.Fatalf("ReadAll() = %q", b)
+	}
+}
+
+func TestLineLimitReader_RejectsOversizeLine(t *testing.T) {
+	lr := newLineLimitReader(strings.NewReader("ok\n"+strings.Repeat("x", 32)+"\n"), 16)
+	_, err := io.ReadAll(lr)
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("ReadAll() error = %v, want ErrLineTooLong", err)
+	}
+}
+
+func TestLineLimitReader_PreservesBytesAfterViolation(t *testing.T) {
+	lr := newLineLimitReader(strings.NewReader("abcdefLEFTOVER"), 5)
+	buf := make([]byte, 64)
+
+	n, err := lr.Read(buf)
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("first Read() error = %v, want ErrLineTooLong", err)
+	}
+	if got := string(buf[:n]); got != "abcdef" {
+		t.Fatalf("first Read() = %q, want %q", got, "abcdef")
+	}
+
+	// A caller that keeps reading after the error must still see the bytes
+	// that were already pulled from the underlying reader, rather than
+	// having them silently dropped.
+	n, err = lr.Read(buf)
+	if err != nil {
+		t.Fatalf("second Read() error = %v, want nil", err)
+	}
+	if got := string(buf[:n]); got != "LEFTOVER" {
+		t.Fatalf("second Read() = %q, want %q", got, "LEFTOVER")
+	}
+}
+
+func TestLineLimitReader_ViolatedSticksAfterOversizeLine(t *testing.T) {
+	lr := newLineLimitReader(strings.NewReader("ok\n"+strings.Repeat("x", 32)+"\n"), 16)
+	if lr.Violated() {
+		t.Fatal("Violated() = true before any line has been read")
+	}
+	io.ReadAll(lr)
+	if !lr.Violated() {
+		t.Fatal("Violated() = false, want true after an oversize line")
+	}
+}
+
+func TestDataReader_SurfacesLineTooLongAsUnrecoverable(t *testing.T) {
+	dr := &dataReader{
+		r: bufio.NewReader(newLineLimitReader(strings.NewReader(strings.Repeat("x", 32)+"\r\n.\r\n"), 16)),
+	}
+	_, err := readAll(dr)
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("Read() error = %v, want ErrLineTooLong", err)
+	}
+	if !dr.Unrecoverable() {
+		t.Fatal("Unrecoverable() = false, want true after oversize line")
+	}
+}
@@ -0,0 +1,56 @@
+package smtp
+
+import "io"
+
+// LMTPSession is implemented by a Session that wants to report delivery
+// status per recipient, as RFC 2033 requires of LMTP: the DATA/BDAT
+// completion must emit one status line per accepted RCPT rather than a
+// single aggregate response. Backends that only implement the plain
+// Session interface keep working unchanged in both SMTP and LMTP mode;
+// Conn falls back to a single response built from the error Data returns.
+// An error LMTPData returns is written for each recipient that has no
+// status of its own.
+type LMTPSession interface {
+	LMTPData(r io.Reader, status StatusCollector) error
+}
+
+// StatusCollector lets an LMTPSession report the outcome of delivering the
+// current message to one recipient at a time, in any order, while Conn is
+// still reading the DATA/BDAT stream.
+type StatusCollector interface {
+	// SetStatus records the outcome for the recipient at rcptIndex, i.e.
+	// its position in the order RCPT TO commands were accepted. A nil err
+	// means that recipient's copy was delivered successfully.
+	SetStatus(rcptIndex int, err error)
+}
+
+// statusCollector is Conn's StatusCollector implementation. It buffers the
+// per-recipient results reported during LMTPData so they can be replayed,
+// in RCPT order, once the transaction completes.
+type statusCollector struct {
+	statuses []error
+}
+
+func newStatusCollector(numRcpts int) *statusCollector {
+	return &statusCollector{statuses: make([]error, numRcpts)}
+}
+
+// SetStatus silently discards rcptIndex values outside the recipient list
+// it was sized for, rather than index out of bounds. A wrong index is an
+// LMTPSession bug rather than anything a remote peer controls, but an
+// unrecovered panic here would bring down the whole process (it runs on a
+// goroutine Conn starts with no recover - the connection's own for DATA, a
+// separate one for BDAT), which is worse than dropping one bad status
+// report.
+func (sc *statusCollector) SetStatus(rcptIndex int, err error) {
+	if rcptIndex < 0 || rcptIndex >= len(sc.statuses) {
+		return
+	}
+	sc.statuses[rcptIndex] = err
+}
+
+// Status returns the outcome recorded for the recipient at rcptIndex, or
+// nil if the backend never reported one for it.
+func (sc *statusCollector) Status(rcptIndex int) error {
+	return sc.statuses[rcptIndex]
+}
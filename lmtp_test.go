@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusCollector_RecordsPerRecipientStatus(t *testing.T) {
+	sc := newStatusCollector(3)
+
+	errRcpt1 := errors.New("mailbox full")
+	sc.SetStatus(0, nil)
+	sc.SetStatus(1, errRcpt1)
+
+	if err := sc.Status(0); err != nil {
+		t.Errorf("Status(0) = %v, want nil", err)
+	}
+	if err := sc.Status(1); err != errRcpt1 {
+		t.Errorf("Status(1) = %v, want %v", err, errRcpt1)
+	}
+	if err := sc.Status(2); err != nil {
+		t.Errorf("Status(2) = %v, want nil for unreported recipient", err)
+	}
+}
+
+func TestStatusCollector_SetStatusIgnoresOutOfRangeIndex(t *testing.T) {
+	sc := newStatusCollector(2)
+
+	sc.SetStatus(-1, errors.New("mailbox full"))
+	sc.SetStatus(2, errors.New("mailbox full"))
+
+	if err := sc.Status(0); err != nil {
+		t.Errorf("Status(0) = %v, want nil", err)
+	}
+	if err := sc.Status(1); err != nil {
+		t.Errorf("Status(1) = %v, want nil", err)
+	}
+}
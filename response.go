@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Localizer translates the default message for code into lang, which is
+// the value of the LANG= parameter the client gave on MAIL FROM (empty if
+// it gave none). It should return the
+// empty string to fall back to the message the caller already has (e.g. an
+// SMTPError's own Message). Assign a Localizer to Server.Localizer.
+type Localizer func(code CodePair, lang string) string
+
+// formatResponse renders a (possibly multi-line) SMTP/LMTP reply for code,
+// applying RFC 2034 enhanced-code discipline: the enhanced code is
+// prepended to every line only when enhanced is true and code carries one,
+// which callers should arrange to be the case exactly when the peer sent
+// EHLO/LHLO and code.Basic is 2xx, 4xx or 5xx.
+func formatResponse(code CodePair, enhanced bool, msg ...string) string {
+	if len(msg) == 0 {
+		msg = []string{""}
+	}
+
+	code.populateEnhancedCode()
+
+	prefix := ""
+	if enhanced && code.Enhanced != NoEnhancedCode {
+		prefix = fmt.Sprintf("%d.%d.%d ", code.Enhanced[0], code.Enhanced[1], code.Enhanced[2])
+	}
+
+	var b strings.Builder
+	for i, line := range msg {
+		sep := byte('-')
+		if i == len(msg)-1 {
+			sep = ' '
+		}
+		fmt.Fprintf(&b, "%d%c%s%s\r\n", code.Basic, sep, prefix, line)
+	}
+	return b.String()
+}
+
+// writeResponse writes a formatted reply to w. It is the shared
+// implementation behind Conn.WriteResponse: Conn determines enhanced from
+// whether the peer sent EHLO/LHLO, applies Server.Localizer (if set) to
+// msg, and then calls this.
+func writeResponse(w io.Writer, code CodePair, enhanced bool, msg ...string) error {
+	_, err := io.WriteString(w, formatResponse(code, enhanced, msg...))
+	return err
+}
+
+// Response formats err as a wire-ready SMTP/LMTP reply, applying the same
+// RFC 2034 enhanced-code discipline as WriteResponse.
+func (err *SMTPError) Response(enhanced bool) string {
+	code := CodePair{Basic: err.Code, Enhanced: err.EnhancedCode}
+	return formatResponse(code, enhanced, err.Message)
+}
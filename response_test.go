@@ -0,0 +1,45 @@
+package smtp
+
+import "testing"
+
+func TestFormatResponse_SingleLineWithEnhancedCode(t *testing.T) {
+	got := formatResponse(CodeOk, true, "Queued")
+	want := "250 2.0.0 Queued\r\n"
+	if got != want {
+		t.Fatalf("formatResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatResponse_SuppressesEnhancedCodeForNonEHLOPeer(t *testing.T) {
+	got := formatResponse(CodeOk, false, "Queued")
+	want := "250 Queued\r\n"
+	if got != want {
+		t.Fatalf("formatResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatResponse_MultiLineContinuation(t *testing.T) {
+	got := formatResponse(CodeOk, true, "line one", "line two", "line three")
+	want := "250-2.0.0 line one\r\n" +
+		"250-2.0.0 line two\r\n" +
+		"250 2.0.0 line three\r\n"
+	if got != want {
+		t.Fatalf("formatResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatResponse_NoEnhancedCodeNeverPrepended(t *testing.T) {
+	got := formatResponse(CodeReady, true, "mx.example.org ESMTP")
+	want := "220 mx.example.org ESMTP\r\n"
+	if got != want {
+		t.Fatalf("formatResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestSMTPError_Response(t *testing.T) {
+	got := ErrBareLineEnding.Response(true)
+	want := "500 5.5.2 bare CR/LF not allowed in DATA\r\n"
+	if got != want {
+		t.Fatalf("Response() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"io"
+	"net"
+)
+
+// Backend is implemented by the application using this package. It creates
+// a new Session for each accepted connection.
+type Backend interface {
+	NewSession(c *Conn) (Session, error)
+}
+
+// Session is implemented by the application to handle a single SMTP
+// transaction.
+type Session interface {
+	Mail(from string) error
+	Rcpt(to string) error
+	Data(r io.Reader) error
+	Reset()
+	Logout() error
+}
+
+// Server is an SMTP server.
+type Server struct {
+	Backend Backend
+
+	Addr   string
+	Domain string
+
+	// MaxMessageBytes limits the size of a message body, accumulated
+	// across DATA or BDAT chunks. Zero means no limit.
+	MaxMessageBytes int64
+
+	// MaxLineLength limits how many bytes may appear in a single command
+	// or DATA line before the connection is terminated. Zero means no
+	// limit.
+	MaxLineLength int
+
+	// Strict rejects bare CR or bare LF inside the DATA stream, guarding
+	// against SMTP smuggling. See dataReader.
+	Strict bool
+
+	// LMTP switches the server from SMTP to LMTP (RFC 2033): the session is
+	// greeted with LHLO instead of HELO/EHLO, and a Session that also
+	// implements LMTPSession gets its per-recipient delivery status
+	// reported back as one response line per RCPT rather than a single
+	// aggregate response.
+	LMTP bool
+
+	// Localizer, if set, lets responses be translated before they go out
+	// over the wire. See the Localizer type.
+	Localizer Localizer
+
+	listener net.Listener
+}
+
+// NewServer returns a new Server backed by bkd.
+func NewServer(bkd Backend) *Server {
+	return &Server{Backend: bkd}
+}
+
+func (s *Server) domain() string {
+	if s.Domain != "" {
+		return s.Domain
+	}
+	return "localhost"
+}
+
+// Serve accepts connections on l, handling each on its own goroutine, until
+// l.Accept returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	s.listener = l
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := newConn(conn, s)
+		go c.serve()
+	}
+}
+
+// Close stops the server from accepting new connections.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}